@@ -0,0 +1,181 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package backlight reads and writes backlight interfaces exposed under
+// /sys/class/backlight and performs the smooth transition between levels
+// shared by every bls subcommand.
+package backlight
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClassPath is where the kernel exposes backlight interfaces.
+const ClassPath = "/sys/class/backlight"
+
+// Device is a single backlight interface.
+type Device struct {
+	Name string
+	Path string
+	Max  int
+}
+
+// MaxPath is the sysfs file holding the device's maximum brightness.
+func (d Device) MaxPath() string { return filepath.Join(d.Path, "max_brightness") }
+
+// CurrPath is the sysfs file holding (and accepting) the current brightness.
+func (d Device) CurrPath() string { return filepath.Join(d.Path, "brightness") }
+
+// IsACPI reports whether this is the generic ACPI video backend, which
+// often reports brightness steps that don't match what the hardware
+// actually does and should only be used when nothing else is found.
+func (d Device) IsACPI() bool {
+	return strings.Contains(d.Name, "acpi")
+}
+
+// Current reads the device's current brightness. This always goes
+// through sysfs: it's world-readable, unlike the brightness file, which
+// normally requires root or a udev rule to write.
+func (d Device) Current() (int, error) {
+	return ReadInt(d.CurrPath())
+}
+
+// Set writes an absolute brightness value directly to sysfs.
+func (d Device) Set(n int) error {
+	return WriteInt(d.CurrPath(), n)
+}
+
+// Writer applies a brightness value to a backlight device. SysfsWriter
+// writes to the device's sysfs file directly; other implementations
+// (e.g. the logind package) can apply the value through a privileged
+// helper instead, so bls can run unprivileged.
+type Writer interface {
+	Set(n int) error
+}
+
+// SysfsWriter is the default Writer: it writes straight to the device's
+// brightness file, which normally requires root or a udev rule.
+type SysfsWriter struct {
+	Device Device
+}
+
+func (w SysfsWriter) Set(n int) error { return w.Device.Set(n) }
+
+// Transition ramps the brightness from curr to set in steps of at most
+// step units via w, sleeping wait between each write, so the change is
+// visible rather than an abrupt jump.
+func Transition(w Writer, curr, set, step int, wait time.Duration) error {
+	if curr > set {
+		for curr > set {
+			curr -= step
+			if curr < set {
+				curr = set
+			}
+			if err := w.Set(curr); err != nil {
+				return err
+			}
+			time.Sleep(wait)
+		}
+		return nil
+	}
+	for curr < set {
+		curr += step
+		if curr > set {
+			curr = set
+		}
+		if err := w.Set(curr); err != nil {
+			return err
+		}
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// Open builds a Device directly from a /sys/class/backlight/* directory,
+// bypassing discovery. It's used when the caller already knows the path
+// to use (e.g. from a -path flag).
+func Open(path string) (Device, error) {
+	name := filepath.Base(path)
+	max, err := ReadInt(filepath.Join(path, "max_brightness"))
+	if err != nil {
+		return Device{}, err
+	}
+	return Device{Name: name, Path: path, Max: max}, nil
+}
+
+// List enumerates every interface under ClassPath.
+func List() ([]Device, error) {
+	entries, err := ioutil.ReadDir(ClassPath)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(entries))
+	for _, e := range entries {
+		path := filepath.Join(ClassPath, e.Name())
+		max, err := ReadInt(filepath.Join(path, "max_brightness"))
+		if err != nil {
+			continue
+		}
+		devices = append(devices, Device{Name: e.Name(), Path: path, Max: max})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+// Choose picks the backlight interface to drive. If name is non-empty it
+// must match one of the given devices. Otherwise the first non-ACPI
+// interface wins, falling back to an ACPI one only if nothing else is
+// available.
+func Choose(devices []Device, name string) (Device, error) {
+	if name != "" {
+		for _, d := range devices {
+			if d.Name == name {
+				return d, nil
+			}
+		}
+		return Device{}, fmt.Errorf("backlight device %q not found under %s", name, ClassPath)
+	}
+	var acpi *Device
+	for i := range devices {
+		if devices[i].IsACPI() {
+			if acpi == nil {
+				acpi = &devices[i]
+			}
+			continue
+		}
+		return devices[i], nil
+	}
+	if acpi != nil {
+		return *acpi, nil
+	}
+	return Device{}, fmt.Errorf("no backlight interface found under %s", ClassPath)
+}
+
+// ReadInt reads a sysfs file containing a single integer.
+func ReadInt(f string) (int, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return -1, err
+	}
+	text := strings.TrimSpace(string(buf))
+	return strconv.Atoi(text)
+}
+
+// WriteInt writes a single integer to a sysfs file.
+func WriteInt(f string, n int) error {
+	buf := fmt.Sprintf("%d\n", n)
+	return ioutil.WriteFile(f, []byte(buf), 0644)
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package curve maps an ambient illuminance reading to a backlight
+// percentage under a choice of response curves, so callers aren't stuck
+// with a straight linear mapping across the huge dynamic range of real
+// ambient light (a dim room is ~10 lux, direct sunlight is ~10000 lux).
+package curve
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Curve maps an averaged illuminance reading to a backlight percentage
+// in the range [0, 100].
+type Curve interface {
+	Map(luxAverage int) (percent int)
+}
+
+func clampPercent(p int) int {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// Linear maps lux to percent proportionally: Ratio lux for each 1%.
+// This is the original bls behavior.
+type Linear struct {
+	Ratio int
+}
+
+func (l Linear) Map(lux int) int {
+	maxIn := l.Ratio * 100
+	if maxIn <= 0 {
+		return 0
+	}
+	return clampPercent(lux * 100 / maxIn)
+}
+
+// Log maps log10(1+lux) linearly between MinLux and MaxLux to 0-100%,
+// which tracks perceived brightness far better than a linear ratio across
+// a wide lux range.
+type Log struct {
+	MinLux, MaxLux int
+}
+
+func (c Log) Map(lux int) int {
+	if lux < c.MinLux {
+		lux = c.MinLux
+	}
+	if lux > c.MaxLux {
+		lux = c.MaxLux
+	}
+	lo := math.Log10(1 + float64(c.MinLux))
+	hi := math.Log10(1 + float64(c.MaxLux))
+	if hi <= lo {
+		return 0
+	}
+	v := math.Log10(1 + float64(lux))
+	return clampPercent(int(math.Round((v - lo) / (hi - lo) * 100)))
+}
+
+// Gamma normalizes lux between MinLux and MaxLux and applies pow(x, 1/G),
+// approximating perceived brightness. G defaults to 2.2 when zero.
+type Gamma struct {
+	MinLux, MaxLux int
+	G              float64
+}
+
+func (c Gamma) Map(lux int) int {
+	if lux < c.MinLux {
+		lux = c.MinLux
+	}
+	if lux > c.MaxLux {
+		lux = c.MaxLux
+	}
+	span := c.MaxLux - c.MinLux
+	if span <= 0 {
+		return 0
+	}
+	g := c.G
+	if g == 0 {
+		g = 2.2
+	}
+	norm := float64(lux-c.MinLux) / float64(span)
+	return clampPercent(int(math.Round(math.Pow(norm, 1/g) * 100)))
+}
+
+// Point is one lux:percent control point of a Piecewise curve.
+type Point struct {
+	Lux     int
+	Percent int
+}
+
+// Piecewise linearly interpolates between user-defined control points,
+// clamping to the first/last point's percent outside their lux range.
+// Points must be sorted by Lux ascending.
+type Piecewise struct {
+	Points []Point
+}
+
+func (c Piecewise) Map(lux int) int {
+	points := c.Points
+	if len(points) == 0 {
+		return 0
+	}
+	if lux <= points[0].Lux {
+		return clampPercent(points[0].Percent)
+	}
+	last := points[len(points)-1]
+	if lux >= last.Lux {
+		return clampPercent(last.Percent)
+	}
+	for i := 1; i < len(points); i++ {
+		if lux > points[i].Lux {
+			continue
+		}
+		a, b := points[i-1], points[i]
+		if b.Lux == a.Lux {
+			return clampPercent(b.Percent)
+		}
+		frac := float64(lux-a.Lux) / float64(b.Lux-a.Lux)
+		p := float64(a.Percent) + frac*float64(b.Percent-a.Percent)
+		return clampPercent(int(math.Round(p)))
+	}
+	return clampPercent(last.Percent)
+}
+
+// Parse builds a Curve from a -curve flag value: "linear", "log",
+// "gamma" or "gamma=G", or "piecewise=lux1:pct1,lux2:pct2,...". Linear
+// uses ratio; log and gamma use the [luxMin, luxMax] range.
+func Parse(spec string, ratio, luxMin, luxMax int) (Curve, error) {
+	switch {
+	case spec == "" || spec == "linear":
+		return Linear{Ratio: ratio}, nil
+	case spec == "log":
+		return Log{MinLux: luxMin, MaxLux: luxMax}, nil
+	case spec == "gamma":
+		return Gamma{MinLux: luxMin, MaxLux: luxMax}, nil
+	case strings.HasPrefix(spec, "gamma="):
+		g, err := strconv.ParseFloat(strings.TrimPrefix(spec, "gamma="), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gamma value: %v", err)
+		}
+		return Gamma{MinLux: luxMin, MaxLux: luxMax, G: g}, nil
+	case strings.HasPrefix(spec, "piecewise="):
+		return parsePiecewise(strings.TrimPrefix(spec, "piecewise="))
+	default:
+		return nil, fmt.Errorf("unknown curve %q", spec)
+	}
+}
+
+func parsePiecewise(s string) (Curve, error) {
+	fields := strings.Split(s, ",")
+	points := make([]Point, 0, len(fields))
+	for _, f := range fields {
+		parts := strings.SplitN(f, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid piecewise point %q, want lux:percent", f)
+		}
+		lux, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid piecewise lux %q: %v", parts[0], err)
+		}
+		pct, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid piecewise percent %q: %v", parts[1], err)
+		}
+		points = append(points, Point{Lux: lux, Percent: pct})
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("piecewise curve needs at least one point")
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Lux < points[j].Lux })
+	return Piecewise{Points: points}, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curve
+
+import "testing"
+
+func assertMonotonic(t *testing.T, name string, c Curve, lo, hi, step int) {
+	t.Helper()
+	prev := c.Map(lo)
+	for lux := lo + step; lux <= hi; lux += step {
+		cur := c.Map(lux)
+		if cur < prev {
+			t.Errorf("%s: Map(%d)=%d < Map(%d)=%d, not monotonic", name, lux, cur, lux-step, prev)
+		}
+		prev = cur
+	}
+}
+
+func TestLinearMonotonicAndClamped(t *testing.T) {
+	c := Linear{Ratio: 20}
+	assertMonotonic(t, "linear", c, 0, 10000, 50)
+	if p := c.Map(0); p != 0 {
+		t.Errorf("Map(0) = %d, want 0", p)
+	}
+	if p := c.Map(1000000); p != 100 {
+		t.Errorf("Map(huge) = %d, want 100 (clamped)", p)
+	}
+}
+
+func TestLogMonotonicAndClamped(t *testing.T) {
+	c := Log{MinLux: 1, MaxLux: 10000}
+	assertMonotonic(t, "log", c, 0, 20000, 50)
+	if p := c.Map(0); p != 0 {
+		t.Errorf("Map(below min) = %d, want 0", p)
+	}
+	if p := c.Map(10000); p != 100 {
+		t.Errorf("Map(max) = %d, want 100", p)
+	}
+	if p := c.Map(50000); p != 100 {
+		t.Errorf("Map(above max) = %d, want 100 (clamped)", p)
+	}
+}
+
+func TestGammaMonotonicAndClamped(t *testing.T) {
+	c := Gamma{MinLux: 1, MaxLux: 10000, G: 2.2}
+	assertMonotonic(t, "gamma", c, 0, 20000, 50)
+	if p := c.Map(1); p != 0 {
+		t.Errorf("Map(min) = %d, want 0", p)
+	}
+	if p := c.Map(10000); p != 100 {
+		t.Errorf("Map(max) = %d, want 100", p)
+	}
+	if p := c.Map(50000); p != 100 {
+		t.Errorf("Map(above max) = %d, want 100 (clamped)", p)
+	}
+}
+
+func TestGammaDefaultsWhenZero(t *testing.T) {
+	c := Gamma{MinLux: 0, MaxLux: 100}
+	if got, want := c.Map(50), (Gamma{MinLux: 0, MaxLux: 100, G: 2.2}).Map(50); got != want {
+		t.Errorf("Map with G=0 = %d, want same as G=2.2 (%d)", got, want)
+	}
+}
+
+func TestPiecewiseMonotonicAndClamped(t *testing.T) {
+	c := Piecewise{Points: []Point{{10, 5}, {500, 50}, {10000, 100}}}
+	assertMonotonic(t, "piecewise", c, 0, 20000, 25)
+	if p := c.Map(0); p != 5 {
+		t.Errorf("Map(below first point) = %d, want 5 (clamped to first)", p)
+	}
+	if p := c.Map(20000); p != 100 {
+		t.Errorf("Map(above last point) = %d, want 100 (clamped to last)", p)
+	}
+	if p := c.Map(10); p != 5 {
+		t.Errorf("Map(first point) = %d, want 5", p)
+	}
+	if p := c.Map(10000); p != 100 {
+		t.Errorf("Map(last point) = %d, want 100", p)
+	}
+	if p := c.Map(255); p != 27 && p != 28 {
+		t.Errorf("Map(midpoint) = %d, want ~27-28 (interpolated)", p)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"", false},
+		{"linear", false},
+		{"log", false},
+		{"gamma", false},
+		{"gamma=2.5", false},
+		{"gamma=abc", true},
+		{"piecewise=10:5,500:50,10000:100", false},
+		{"piecewise=", true},
+		{"piecewise=bad", true},
+		{"nonsense", true},
+	}
+	for _, tc := range cases {
+		_, err := Parse(tc.spec, 20, 1, 10000)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tc.spec, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dbusapi publishes the bls daemon on the session bus as
+// dev.dullgiulio.bls1, so a status bar or applet can display its state
+// and offer manual overrides while it keeps tracking ambient light.
+package dbusapi
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+const (
+	// Name is the well-known bus name the daemon requests.
+	Name = "dev.dullgiulio.bls1"
+	// Path is the object path the daemon exports its interface on.
+	Path = dbus.ObjectPath("/dev/dullgiulio/bls1")
+	// Iface is the interface name of the exported methods and signal.
+	Iface = "dev.dullgiulio.bls1"
+)
+
+const introspectXML = `
+<node>
+	<interface name="dev.dullgiulio.bls1">
+		<method name="Pause"></method>
+		<method name="Resume"></method>
+		<method name="SetOffset">
+			<arg direction="in" type="i"/>
+		</method>
+		<method name="GetState">
+			<arg direction="out" type="i" name="lux"/>
+			<arg direction="out" type="i" name="backlight"/>
+			<arg direction="out" type="i" name="target"/>
+			<arg direction="out" type="b" name="paused"/>
+		</method>
+		<signal name="BrightnessChanged">
+			<arg type="i" name="lux"/>
+			<arg type="i" name="backlight"/>
+			<arg type="i" name="target"/>
+		</signal>
+	</interface>` + introspect.IntrospectDataString + `
+</node>`
+
+// Service exposes the daemon's pause/offset controls and current state
+// on the session bus.
+type Service struct {
+	conn *dbus.Conn
+
+	mu        sync.Mutex
+	paused    bool
+	offset    int32
+	lux       int32
+	backlight int32
+	target    int32
+}
+
+// New connects to the session bus, exports the service at Path, and
+// requests the well-known Name.
+func New() (*Service, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to session bus: %v", err)
+	}
+	s := &Service{conn: conn}
+	if err := conn.Export(s, Path, Iface); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot export %s: %v", Iface, err)
+	}
+	if err := conn.Export(introspect.Introspectable(introspectXML), Path, "org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot export introspection data: %v", err)
+	}
+	reply, err := conn.RequestName(Name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot request name %s: %v", Name, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("name %s already taken", Name)
+	}
+	return s, nil
+}
+
+// Close releases the session bus connection.
+func (s *Service) Close() error { return s.conn.Close() }
+
+// Pause is the exported D-Bus method that stops the daemon from writing
+// backlight changes until Resume is called.
+func (s *Service) Pause() *dbus.Error {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+	return nil
+}
+
+// Resume is the exported D-Bus method that lets the daemon resume
+// tracking ambient light after a Pause.
+func (s *Service) Resume() *dbus.Error {
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+	return nil
+}
+
+// SetOffset is the exported D-Bus method that biases the daemon's
+// computed target by percent, e.g. so a keybinding can nudge brightness
+// without stopping auto-mode. percent is clamped to [-100, 100]: it is
+// added to a 0-100 curve percentage before the result is clamped again,
+// so a caller can't use an out-of-range offset to drive the target
+// negative or past 100.
+func (s *Service) SetOffset(percent int32) *dbus.Error {
+	switch {
+	case percent < -100:
+		percent = -100
+	case percent > 100:
+		percent = 100
+	}
+	s.mu.Lock()
+	s.offset = percent
+	s.mu.Unlock()
+	return nil
+}
+
+// GetState is the exported D-Bus method reporting the last known
+// illuminance, actual backlight, computed target and pause state.
+func (s *Service) GetState() (int32, int32, int32, bool, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lux, s.backlight, s.target, s.paused, nil
+}
+
+// Paused reports whether the daemon should currently withhold changes.
+func (s *Service) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// Offset returns the bias in percent last set via SetOffset.
+func (s *Service) Offset() int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offset
+}
+
+// SetState records the daemon's latest readings for GetState, and emits
+// BrightnessChanged so listeners don't have to poll.
+func (s *Service) SetState(lux, backlight, target int) {
+	s.mu.Lock()
+	s.lux, s.backlight, s.target = int32(lux), int32(backlight), int32(target)
+	s.mu.Unlock()
+	s.conn.Emit(Path, Iface+".BrightnessChanged", int32(lux), int32(backlight), int32(target))
+}
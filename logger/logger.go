@@ -0,0 +1,156 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logger is a small leveled logger for bls. Unlike a plain
+// log.Logger per verbosity, a level can be reconfigured at runtime and
+// records can be emitted as JSON so the daemon's output is machine
+// parseable for graphing.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is a logging severity. Higher levels are more verbose.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	case LevelTrace:
+		return "trace"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel parses the -log-level flag value.
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "error":
+		return LevelError, nil
+	case "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format selects how log records are rendered.
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat parses the -log-format flag value.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q", s)
+}
+
+// Fields are the optional numeric fields attached to a log record, e.g.
+// lux, lux_pct, backlight_from, backlight_to, diff.
+type Fields map[string]int
+
+// Logger writes leveled, optionally structured, log records to out.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  Level
+	format Format
+}
+
+// New returns a Logger that writes records at level or more severe to
+// out, in the given format.
+func New(out io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: out, level: level, format: format}
+}
+
+func (l *Logger) enabled(level Level) bool { return level <= l.level }
+
+func (l *Logger) record(level Level, event, msg string, fields Fields) {
+	if !l.enabled(level) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch l.format {
+	case FormatJSON:
+		rec := struct {
+			Timestamp string `json:"timestamp"`
+			Level     string `json:"level"`
+			Event     string `json:"event"`
+			Message   string `json:"message,omitempty"`
+			Fields    Fields `json:"fields,omitempty"`
+		}{
+			Timestamp: time.Now().Format(time.RFC3339Nano),
+			Level:     level.String(),
+			Event:     event,
+			Message:   msg,
+			Fields:    fields,
+		}
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			fmt.Fprintf(l.out, "bls: cannot marshal log record: %v\n", err)
+			return
+		}
+		l.out.Write(append(buf, '\n'))
+	default:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %-5s %s", time.Now().Format(time.RFC3339), level.String(), event)
+		if msg != "" {
+			fmt.Fprintf(&b, " %s", msg)
+		}
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%d", k, fields[k])
+		}
+		fmt.Fprintln(l.out, b.String())
+	}
+}
+
+func (l *Logger) Error(event, msg string, fields Fields) { l.record(LevelError, event, msg, fields) }
+func (l *Logger) Info(event, msg string, fields Fields)  { l.record(LevelInfo, event, msg, fields) }
+func (l *Logger) Debug(event, msg string, fields Fields) { l.record(LevelDebug, event, msg, fields) }
+func (l *Logger) Trace(event, msg string, fields Fields) { l.record(LevelTrace, event, msg, fields) }
+
+// Fatal logs event at error level, then exits the process, mirroring
+// log.Fatal.
+func (l *Logger) Fatal(event, msg string, fields Fields) {
+	l.record(LevelError, event, msg, fields)
+	os.Exit(1)
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logind sets backlight brightness through logind's
+// org.freedesktop.login1.Session.SetBrightness method instead of writing
+// to sysfs directly, so bls can run unprivileged the same way
+// brightnessctl and GNOME do.
+package logind
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	busName    = "org.freedesktop.login1"
+	sessionObj = "/org/freedesktop/login1/session/self"
+	sessionIfc = "org.freedesktop.login1.Session"
+)
+
+// Writer implements backlight.Writer by calling logind's SetBrightness
+// on the caller's own session.
+type Writer struct {
+	conn    *dbus.Conn
+	session dbus.BusObject
+	device  string
+}
+
+// NewWriter connects to the system bus and returns a Writer that sets
+// the brightness of the named backlight device (e.g. "intel_backlight")
+// via logind. It pings the session object first, so a caller picking
+// between backends (e.g. -backend=auto) finds out logind isn't reachable
+// here instead of during the first Set.
+func NewWriter(device string) (*Writer, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to system bus: %v", err)
+	}
+	session := conn.Object(busName, dbus.ObjectPath(sessionObj))
+	if call := session.Call("org.freedesktop.DBus.Peer.Ping", 0); call.Err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("logind session %s not reachable: %v", sessionObj, call.Err)
+	}
+	return &Writer{
+		conn:    conn,
+		session: session,
+		device:  device,
+	}, nil
+}
+
+// Set calls Session.SetBrightness(backlight, device, n).
+func (w *Writer) Set(n int) error {
+	call := w.session.Call(sessionIfc+".SetBrightness", 0, "backlight", w.device, uint32(n))
+	return call.Err
+}
+
+// Close releases the system bus connection.
+func (w *Writer) Close() error {
+	return w.conn.Close()
+}
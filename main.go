@@ -5,196 +5,525 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"runtime"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
-)
 
-var (
-	dlog *log.Logger // debug logger
-	vlog *log.Logger // verbose log
-	elog *log.Logger // error log
+	"github.com/dullgiulio/bls/backlight"
+	"github.com/dullgiulio/bls/curve"
+	"github.com/dullgiulio/bls/dbusapi"
+	"github.com/dullgiulio/bls/logger"
+	"github.com/dullgiulio/bls/logind"
+	"github.com/dullgiulio/bls/smoother"
 )
 
-func init() {
-	runtime.GOMAXPROCS(1)
+const iioBusPath = "/sys/bus/iio/devices"
+
+// sensorDevice describes an ambient light sensor found under iioBusPath.
+type sensorDevice struct {
+	name string
+	path string // path to the in_illuminance_raw file
 }
 
-const (
-	illuminancePath   = "/sys/bus/iio/devices/iio:device0/in_illuminance_raw"
-	backlightMaxPath  = "/sys/class/backlight/intel_backlight/max_brightness"
-	backlightCurrPath = "/sys/class/backlight/intel_backlight/brightness"
-)
+// listSensors enumerates every iio:device* node under iioBusPath that
+// exposes an in_illuminance_raw reading.
+func listSensors() ([]sensorDevice, error) {
+	entries, err := ioutil.ReadDir(iioBusPath)
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]sensorDevice, 0)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "iio:device") {
+			continue
+		}
+		raw := filepath.Join(iioBusPath, e.Name(), "in_illuminance_raw")
+		if _, err := os.Stat(raw); err != nil {
+			continue
+		}
+		sensors = append(sensors, sensorDevice{name: e.Name(), path: raw})
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].name < sensors[j].name })
+	return sensors, nil
+}
+
+// chooseSensor picks the first illuminance sensor found under iioBusPath.
+func chooseSensor(sensors []sensorDevice) (sensorDevice, error) {
+	if len(sensors) == 0 {
+		return sensorDevice{}, errors.New("no illuminance sensor found under " + iioBusPath)
+	}
+	return sensors[0], nil
+}
+
+// listDevices prints every discovered backlight and illuminance sensor
+// together with their max/raw values, for use with -list.
+func listDevices() error {
+	backlights, err := backlight.List()
+	if err != nil {
+		return err
+	}
+	fmt.Println("backlights:")
+	for _, d := range backlights {
+		kind := ""
+		if d.IsACPI() {
+			kind = " (acpi fallback)"
+		}
+		fmt.Printf("  %s\tmax=%d%s\n", d.Name, d.Max, kind)
+	}
+	sensors, err := listSensors()
+	if err != nil {
+		return err
+	}
+	fmt.Println("sensors:")
+	for _, s := range sensors {
+		val, err := backlight.ReadInt(s.path)
+		if err != nil {
+			fmt.Printf("  %s\t(unreadable: %v)\n", s.name, err)
+			continue
+		}
+		fmt.Printf("  %s\tvalue=%d\n", s.name, val)
+	}
+	return nil
+}
+
+// rootFlags are the persistent flags accepted by every subcommand.
+type rootFlags struct {
+	path    string
+	device  string
+	backend string
+}
+
+func (rf *rootFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&rf.path, "path", "", "Path `P` to a "+backlight.ClassPath+"/* directory to use directly (overrides auto-detection)")
+	fs.StringVar(&rf.device, "device", "", "Name `D` of the backlight interface to use under "+backlight.ClassPath+" (auto-detected if empty)")
+	fs.StringVar(&rf.backend, "backend", "auto", "Backend `B` used to write backlight values: sysfs, logind, auto (logind if reachable, sysfs otherwise)")
+}
+
+// resolve picks the backlight device named by the persistent flags,
+// either opening -path directly or falling back to auto-detection
+// narrowed by -device.
+func (rf *rootFlags) resolve() (backlight.Device, error) {
+	if rf.path != "" {
+		return backlight.Open(rf.path)
+	}
+	devices, err := backlight.List()
+	if err != nil {
+		return backlight.Device{}, fmt.Errorf("cannot list backlight interfaces: %v", err)
+	}
+	return backlight.Choose(devices, rf.device)
+}
+
+// writer builds the backlight.Writer named by -backend for d. "auto"
+// prefers logind, so bls can run unprivileged, and falls back to sysfs
+// if the session bus or logind aren't reachable.
+func (rf *rootFlags) writer(d backlight.Device) (backlight.Writer, error) {
+	switch rf.backend {
+	case "sysfs":
+		return backlight.SysfsWriter{Device: d}, nil
+	case "logind":
+		return logind.NewWriter(d.Name)
+	case "auto", "":
+		w, err := logind.NewWriter(d.Name)
+		if err != nil {
+			return backlight.SysfsWriter{Device: d}, nil
+		}
+		return w, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", rf.backend)
+	}
+}
 
-func sysfileReadInt(f string) (int, error) {
-	file, err := os.Open(f)
+// logFlags are the flags controlling the daemon's leveled logger.
+type logFlags struct {
+	level  string
+	format string
+}
+
+func (lf *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&lf.level, "log-level", "info", "Minimum `L`evel to log: error, info, debug, trace")
+	fs.StringVar(&lf.format, "log-format", "text", "Log output `F`ormat: text, json")
+}
+
+func (lf *logFlags) build() (*logger.Logger, error) {
+	level, err := logger.ParseLevel(lf.level)
+	if err != nil {
+		return nil, err
+	}
+	format, err := logger.ParseFormat(lf.format)
 	if err != nil {
-		return -1, err
+		return nil, err
+	}
+	return logger.New(os.Stdout, level, format), nil
+}
+
+// curveFlags are the flags controlling the lux-to-percent response curve,
+// shared by the daemon and status subcommands.
+type curveFlags struct {
+	spec           string
+	ratio          int
+	luxMin, luxMax int
+}
+
+func (cf *curveFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&cf.spec, "curve", "linear", "Response `C`urve mapping illuminance to backlight: linear, log, gamma[=G], piecewise=lux1:pct1,lux2:pct2,...")
+	fs.IntVar(&cf.ratio, "ratio", 20, "Ratio `R` of light change: number of lux for a 1% change in backlight (linear curve only)")
+	fs.IntVar(&cf.luxMin, "lux-min", 1, "Lux value `N` mapped to 0% by the log and gamma curves")
+	fs.IntVar(&cf.luxMax, "lux-max", 10000, "Lux value `N` mapped to 100% by the log and gamma curves")
+}
+
+func (cf *curveFlags) build() (curve.Curve, error) {
+	return curve.Parse(cf.spec, cf.ratio, cf.luxMin, cf.luxMax)
+}
+
+// clampPercent restricts p to [0, 100], so a -offset bias from the
+// session bus (dbusapi.Service.SetOffset) can't push it out of range.
+func clampPercent(p int) int {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// targetBacklight turns a curve percentage into a backlight value within
+// [min, max].
+func targetBacklight(percent, min, max int) int {
+	percent = clampPercent(percent)
+	nblight := percent*max/100 + min
+	if nblight > max {
+		nblight = max
+	}
+	if nblight < min {
+		nblight = min
+	}
+	return nblight
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "daemon":
+		err = cmdDaemon(os.Args[2:])
+	case "set":
+		err = cmdSet(os.Args[2:])
+	case "get":
+		err = cmdGet(os.Args[2:])
+	case "status":
+		err = cmdStatus(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
 	}
-	defer file.Close()
-	buf, err := ioutil.ReadAll(file)
 	if err != nil {
-		return -1, err
+		fmt.Fprintln(os.Stderr, "bls: error:", err)
+		os.Exit(1)
 	}
-	text := strings.TrimSpace(string(buf))
-	return strconv.Atoi(text)
 }
 
-func sysfileWriteInt(name string, n int) error {
-	buf := fmt.Sprintf("%d\n", n)
-	return ioutil.WriteFile(name, []byte(buf), 0644)
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  daemon    run the ambient-light polling daemon
+  set       write an absolute or relative backlight value
+  get       print the current backlight value
+  status    print the current illuminance and the value the daemon would set
+
+Run "%s <command> -h" for flags accepted by a command.
+`, os.Args[0], os.Args[0])
 }
 
 type poller struct {
-	probes   int
-	max, min int
-	grad     int
-	sens     int
-	ratio    int
-	dryrun   bool
-	debug    bool
-	wait     time.Duration
-	gradWait time.Duration
+	max, min       int
+	grad           int
+	sens           int
+	alpha          float64
+	sampleInterval time.Duration
+	raiseDelay     time.Duration
+	lowerDelay     time.Duration
+	dryrun         bool
+	gradWait       time.Duration
+
+	curve     curve.Curve
+	backlight backlight.Device
+	writer    backlight.Writer
+	sensor    sensorDevice
+	log       *logger.Logger
+	svc       *dbusapi.Service // nil if the session bus service couldn't be published
 }
 
 func (p *poller) poll() {
-	var inIndex int
-	inlights := make([]int, p.probes)
-	granularity := 100
-	maxIn := p.ratio * granularity
+	ema := smoother.EMA{Alpha: p.alpha}
+	hyst := smoother.Hysteresis{RaiseDelay: p.raiseDelay, LowerDelay: p.lowerDelay}
+	var lastLux, lastBlight, lastTarget int
+	published := false
 	for {
-		var inlight int
-		var err error
-		blight, err := sysfileReadInt(backlightCurrPath)
+		blight, err := p.backlight.Current()
 		if err != nil {
-			elog.Fatal("cannot get backlight value: ", err)
+			p.log.Fatal("read_backlight", err.Error(), nil)
 		}
-		for {
-			inlight, err = sysfileReadInt(illuminancePath)
-			if err != nil {
-				elog.Fatal("cannot get ambient light value: ", err)
-			}
-			inlights[inIndex] = inlight
-			inIndex = (inIndex + 1) % cap(inlights)
-			if inIndex == 0 {
-				break
-			}
-		}
-		inlight = 0
-		n := 0
-		// Average light in the last inlights probes
-		for i := 0; i < len(inlights); i++ {
-			inlight += inlights[i]
-		}
-		if n > 0 {
-			inlight = inlight / n
-		}
-		inlightPercent := inlight * granularity / maxIn
-		if inlightPercent > granularity {
-			inlightPercent = granularity
+		raw, err := backlight.ReadInt(p.sensor.path)
+		if err != nil {
+			p.log.Fatal("read_illuminance", err.Error(), nil)
 		}
-		nblight := inlightPercent*p.max/granularity + p.min
-		if nblight > p.max {
-			nblight = p.max
+		avg := ema.Update(raw)
+		percent := p.curve.Map(avg)
+		nblight := targetBacklight(percent, p.min, p.max)
+		if p.svc != nil {
+			nblight = targetBacklight(percent+int(p.svc.Offset()), p.min, p.max)
 		}
 		diff := nblight - blight
-		if diff < 0 {
-			diff = -diff
+		dir := 0
+		switch {
+		case diff >= p.sens:
+			dir = 1
+		case -diff >= p.sens:
+			dir = -1
 		}
-		dlog.Printf("light = %d (%d%%), back-light = %d, set %d (diff %d, min-diff %d)", inlight, inlightPercent, blight, nblight, diff, p.sens)
-		// Set backlight if there is more than the minimum change thresold to adjust. Or if we are below min (level was never set.)
-		if diff >= p.sens || blight < p.min {
-			vlog.Printf("change backlight to %d%%; illuminance = %d, backlight = %d (was %d)", inlightPercent, inlight, nblight, blight)
+		fields := logger.Fields{"lux": avg, "lux_pct": percent, "backlight_from": blight, "backlight_to": nblight, "diff": diff}
+		p.log.Debug("poll", "", fields)
+		paused := p.svc != nil && p.svc.Paused()
+		// Only act once the hysteresis state machine has seen the change
+		// sustained for raiseDelay/lowerDelay, or if the level was never
+		// set. This keeps brief shadows or flashes from triggering a change.
+		ready := hyst.Step(dir, p.sampleInterval) && !paused
+		if ready || (blight < p.min && !paused) {
+			p.log.Info("set_backlight", "", fields)
 			if !p.dryrun {
-				if err := p.setBlight(blight, nblight); err != nil {
-					elog.Fatal("cannot set backlight: ", err)
+				if err := backlight.Transition(p.writer, blight, nblight, p.grad, p.gradWait); err != nil {
+					p.log.Fatal("set_backlight", err.Error(), fields)
 				}
 			}
-			continue // When light was changed, probe again right away
 		}
-		time.Sleep(p.wait)
+		if p.svc != nil && (!published || avg != lastLux || blight != lastBlight || nblight != lastTarget) {
+			p.svc.SetState(avg, blight, nblight)
+			lastLux, lastBlight, lastTarget = avg, blight, nblight
+			published = true
+		}
+		time.Sleep(p.sampleInterval)
 	}
 }
 
-// Make a simple transition between backlight levels
-func (p *poller) setBlight(curr, set int) error {
-	// Decrease
-	if curr > set {
-		for curr > set {
-			curr -= p.grad
-			if curr < set {
-				curr = set
-			}
-			if err := sysfileWriteInt(backlightCurrPath, curr); err != nil {
-				return err
-			}
-			time.Sleep(p.gradWait)
-		}
-		return nil
+func cmdDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	var rf rootFlags
+	rf.register(fs)
+	var cf curveFlags
+	cf.register(fs)
+	var lf logFlags
+	lf.register(fs)
+	p := poller{
+		grad:           5,  // how much to change backlight for gradual change
+		min:            40, // backlight min N
+		max:            0,  // backlight max N (0 = autodetect)
+		sens:           18, // sensitivity %
+		alpha:          0.2,
+		sampleInterval: 250 * time.Millisecond,
+		raiseDelay:     time.Second,
+		lowerDelay:     5 * time.Second,
+		dryrun:         false,
+		gradWait:       200 * time.Millisecond,
 	}
-	// Increase
-	for curr < set {
-		curr += p.grad
-		if curr > set {
-			curr = set
-		}
-		if err := sysfileWriteInt(backlightCurrPath, curr); err != nil {
-			return err
-		}
-		time.Sleep(p.gradWait)
+	var list bool
+	var dbusService bool
+	fs.BoolVar(&dbusService, "dbus-service", true, "Publish dev.dullgiulio.bls1 on the session bus for status bars/applets to query and control")
+	fs.IntVar(&p.grad, "animation-steps", p.grad, "Number `N` of backlight to add or remove to smoothly change backlight")
+	fs.IntVar(&p.min, "min", p.min, "Minimum value `N` for backlight")
+	fs.IntVar(&p.max, "max", p.max, "Maximum value `N` for backlight (0 = autodetected)")
+	fs.IntVar(&p.sens, "sensitivity", p.sens, "Minimum amount `S` in percent of backlight change to perform")
+	fs.Float64Var(&p.alpha, "alpha", p.alpha, "Weight `A` given to each new illuminance sample in the exponential moving average")
+	fs.DurationVar(&p.sampleInterval, "sample-interval", p.sampleInterval, "Duration `T` between illuminance samples")
+	fs.DurationVar(&p.raiseDelay, "raise-delay", p.raiseDelay, "Duration `T` the averaged illuminance must stay above the raise threshold before backlight is raised")
+	fs.DurationVar(&p.lowerDelay, "lower-delay", p.lowerDelay, "Duration `T` the averaged illuminance must stay below the lower threshold before backlight is lowered")
+	fs.BoolVar(&p.dryrun, "dryrun", p.dryrun, "Do not set backlight, only print what would happen")
+	fs.DurationVar(&p.gradWait, "animation", p.gradWait, "Duration `T` for smooth animation on light change")
+	fs.BoolVar(&list, "list", list, "List discovered backlight and illuminance interfaces and exit")
+	fs.Parse(args)
+
+	if list {
+		return listDevices()
 	}
-	return nil
-}
 
-func main() {
-	p := poller{
-		probes:   8,
-		grad:     5,  // how much to change backlight for gradual change
-		min:      40, // backlight min N
-		max:      0,  // backlight max N (0 = autodetect)
-		sens:     18, // sensitivity %
-		ratio:    20, // lux = 1%
-		dryrun:   false,
-		debug:    false,
-		wait:     4 * time.Second,
-		gradWait: 200 * time.Millisecond,
-	}
-	flag.IntVar(&p.grad, "animation-steps", p.grad, "Number `N` of backlight to add or remove to smoothly change backlight")
-	flag.IntVar(&p.probes, "probes", p.probes, "Number `N` of illuminance probes to average")
-	flag.IntVar(&p.min, "min", p.min, "Minimum value `N` for backlight")
-	flag.IntVar(&p.max, "max", p.max, "Maximum value `N` for backlight (0 = autodetected)")
-	flag.IntVar(&p.sens, "sensitivity", p.sens, "Minimum amount `S` in percent of backlight change to perform")
-	flag.IntVar(&p.ratio, "ratio", p.ratio, "Ratio `R` of light change: number of lux for a 1% change in backlight")
-	flag.BoolVar(&p.dryrun, "dryrun", p.dryrun, "Do not set backlight, only print what would happen")
-	flag.BoolVar(&p.debug, "debug", p.debug, "Print values read from sensors every wait duration")
-	flag.DurationVar(&p.wait, "wait", p.wait, "Duration `T` between checks for changed light conditions")
-	flag.DurationVar(&p.gradWait, "animation", p.gradWait, "Duration `T` for smooth animation on light change")
-	flag.Parse()
-	dlogOut := ioutil.Discard
-	vlogOut := ioutil.Discard
-	elogOut := os.Stderr
-	if p.dryrun {
-		vlogOut = os.Stdout
-	}
-	if p.debug {
-		dlogOut = os.Stdout
-		vlogOut = os.Stdout
-	}
-	elog = log.New(elogOut, "bls: error: ", log.LstdFlags)
-	dlog = log.New(dlogOut, "bls: debug: ", log.LstdFlags)
-	vlog = log.New(vlogOut, "bls: info: ", log.LstdFlags)
+	var err error
+	p.log, err = lf.build()
+	if err != nil {
+		return err
+	}
+	p.curve, err = cf.build()
+	if err != nil {
+		return err
+	}
+	p.backlight, err = rf.resolve()
+	if err != nil {
+		return err
+	}
+	p.writer, err = rf.writer(p.backlight)
+	if err != nil {
+		return err
+	}
+	sensors, err := listSensors()
+	if err != nil {
+		return fmt.Errorf("cannot list illuminance sensors: %v", err)
+	}
+	p.sensor, err = chooseSensor(sensors)
+	if err != nil {
+		return err
+	}
 	if p.max == 0 {
-		var err error
-		p.max, err = sysfileReadInt(backlightMaxPath)
+		p.max = p.backlight.Max
+	}
+	if dbusService {
+		svc, err := dbusapi.New()
 		if err != nil {
-			elog.Fatal("cannot get backlight max value: ", err)
+			p.log.Error("dbus_service", err.Error(), nil)
+		} else {
+			defer svc.Close()
+			p.svc = svc
 		}
 	}
+	p.log.Info("start", fmt.Sprintf("using backlight %q, sensor %q", p.backlight.Name, p.sensor.name), nil)
 	p.poll()
+	return nil
+}
+
+// parseValue parses a `bls set` argument: an optional leading +/- marks
+// the value as relative to curr, and an optional trailing % marks it as
+// a percentage of max rather than a raw unit count.
+func parseValue(s string, curr, max int) (int, error) {
+	if s == "" {
+		return 0, errors.New("missing value")
+	}
+	relative := 0
+	switch s[0] {
+	case '+':
+		relative = 1
+		s = s[1:]
+	case '-':
+		relative = -1
+		s = s[1:]
+	}
+	percent := false
+	if strings.HasSuffix(s, "%") {
+		percent = true
+		s = strings.TrimSuffix(s, "%")
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q: %v", s, err)
+	}
+	if percent {
+		n = n * max / 100
+	}
+	if relative != 0 {
+		n = curr + relative*n
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > max {
+		n = max
+	}
+	return n, nil
+}
+
+func cmdSet(args []string) error {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	var rf rootFlags
+	rf.register(fs)
+	grad := 5
+	gradWait := 200 * time.Millisecond
+	fs.IntVar(&grad, "animation-steps", grad, "Number `N` of backlight to add or remove to smoothly change backlight")
+	fs.DurationVar(&gradWait, "animation", gradWait, "Duration `T` for smooth animation on light change")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: bls set [+|-]N[%]")
+	}
+	d, err := rf.resolve()
+	if err != nil {
+		return err
+	}
+	w, err := rf.writer(d)
+	if err != nil {
+		return err
+	}
+	curr, err := d.Current()
+	if err != nil {
+		return fmt.Errorf("cannot get backlight value: %v", err)
+	}
+	set, err := parseValue(fs.Arg(0), curr, d.Max)
+	if err != nil {
+		return err
+	}
+	return backlight.Transition(w, curr, set, grad, gradWait)
+}
+
+func cmdGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	var rf rootFlags
+	rf.register(fs)
+	fs.Parse(args)
+	d, err := rf.resolve()
+	if err != nil {
+		return err
+	}
+	curr, err := d.Current()
+	if err != nil {
+		return fmt.Errorf("cannot get backlight value: %v", err)
+	}
+	percent := 0
+	if d.Max > 0 {
+		percent = curr * 100 / d.Max
+	}
+	fmt.Printf("current: %d\nmax: %d\npercent: %d%%\n", curr, d.Max, percent)
+	return nil
+}
+
+func cmdStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var rf rootFlags
+	rf.register(fs)
+	var cf curveFlags
+	cf.register(fs)
+	min := 40
+	fs.IntVar(&min, "min", min, "Minimum value `N` for backlight")
+	fs.Parse(args)
+	c, err := cf.build()
+	if err != nil {
+		return err
+	}
+	d, err := rf.resolve()
+	if err != nil {
+		return err
+	}
+	sensors, err := listSensors()
+	if err != nil {
+		return fmt.Errorf("cannot list illuminance sensors: %v", err)
+	}
+	s, err := chooseSensor(sensors)
+	if err != nil {
+		return err
+	}
+	lux, err := backlight.ReadInt(s.path)
+	if err != nil {
+		return fmt.Errorf("cannot get ambient light value: %v", err)
+	}
+	curr, err := d.Current()
+	if err != nil {
+		return fmt.Errorf("cannot get backlight value: %v", err)
+	}
+	fmt.Printf("illuminance: %d\ncurrent: %d\ntarget: %d\n", lux, curr, targetBacklight(c.Map(lux), min, d.Max))
+	return nil
 }
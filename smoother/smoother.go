@@ -0,0 +1,76 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package smoother smooths a noisy illuminance stream and decides when a
+// sustained change has earned a backlight adjustment, so brief shadows
+// or flashes across the sensor don't trigger one.
+package smoother
+
+import (
+	"math"
+	"time"
+)
+
+// EMA is an exponential moving average: each sample contributes Alpha of
+// the new value, the rest carries over from the previous average.
+type EMA struct {
+	Alpha float64
+
+	value float64
+	init  bool
+}
+
+// Update folds in one sample and returns the rounded running average.
+func (e *EMA) Update(sample int) int {
+	if !e.init {
+		e.value = float64(sample)
+		e.init = true
+	} else {
+		e.value = e.Alpha*float64(sample) + (1-e.Alpha)*e.value
+	}
+	return int(math.Round(e.value))
+}
+
+// Hysteresis tracks how long a desired backlight change has pointed in
+// the same direction, and only reports the change as ready once it has
+// been sustained for RaiseDelay (increasing) or LowerDelay (decreasing).
+// Once ready in a direction, it stays ready for as long as that
+// direction holds; a sign change or a neutral reading resets the timer.
+type Hysteresis struct {
+	RaiseDelay time.Duration
+	LowerDelay time.Duration
+
+	dir     int
+	elapsed time.Duration
+	ready   bool
+}
+
+// Step advances the state machine by dt given dir, the sign of the
+// desired change (+1 raise, -1 lower, 0 within the sensitivity band).
+// It returns whether the change is ready to be applied.
+func (h *Hysteresis) Step(dir int, dt time.Duration) bool {
+	if dir == 0 {
+		h.dir = 0
+		h.elapsed = 0
+		h.ready = false
+		return false
+	}
+	if dir != h.dir {
+		h.dir = dir
+		h.elapsed = 0
+		h.ready = false
+	}
+	if h.ready {
+		return true
+	}
+	h.elapsed += dt
+	delay := h.LowerDelay
+	if dir > 0 {
+		delay = h.RaiseDelay
+	}
+	if h.elapsed >= delay {
+		h.ready = true
+	}
+	return h.ready
+}
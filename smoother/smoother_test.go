@@ -0,0 +1,88 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smoother
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEMAConvergesTowardsSteadySample(t *testing.T) {
+	e := EMA{Alpha: 0.2}
+	prev := e.Update(0)
+	for i := 0; i < 50; i++ {
+		cur := e.Update(1000)
+		if cur < prev {
+			t.Fatalf("EMA decreased (%d -> %d) while sampling a constant higher value", prev, cur)
+		}
+		prev = cur
+	}
+	if prev != 1000 {
+		t.Errorf("EMA after 50 samples of 1000 = %d, want 1000", prev)
+	}
+}
+
+func TestEMAIgnoresASingleSpike(t *testing.T) {
+	e := EMA{Alpha: 0.2}
+	for i := 0; i < 10; i++ {
+		e.Update(100)
+	}
+	spiked := e.Update(100000)
+	if spiked > 20100 {
+		t.Errorf("a single spike moved the EMA to %d, expected it to be damped well below the raw sample", spiked)
+	}
+}
+
+func TestHysteresisWithholdsUntilSustained(t *testing.T) {
+	h := Hysteresis{RaiseDelay: time.Second, LowerDelay: 5 * time.Second}
+	if h.Step(1, 900*time.Millisecond) {
+		t.Fatal("raise reported ready before raiseDelay elapsed")
+	}
+	if !h.Step(1, 200*time.Millisecond) {
+		t.Fatal("raise should be ready once sustained past raiseDelay")
+	}
+}
+
+func TestHysteresisBriefFlashDoesNotTrigger(t *testing.T) {
+	h := Hysteresis{RaiseDelay: time.Second, LowerDelay: 5 * time.Second}
+	h.Step(1, 900*time.Millisecond)
+	if h.Step(0, 250*time.Millisecond) {
+		t.Fatal("neutral reading must reset pending state, not report ready")
+	}
+	if h.Step(1, 900*time.Millisecond) {
+		t.Fatal("raise timer should have been reset by the intervening neutral reading")
+	}
+}
+
+func TestHysteresisDirectionChangeResets(t *testing.T) {
+	h := Hysteresis{RaiseDelay: time.Second, LowerDelay: 5 * time.Second}
+	h.Step(1, 900*time.Millisecond)
+	if h.Step(-1, 4*time.Second) {
+		t.Fatal("lower should need lowerDelay of its own, not inherit raise's elapsed time")
+	}
+	if !h.Step(-1, time.Second) {
+		t.Fatal("lower should be ready once sustained past lowerDelay")
+	}
+}
+
+func TestHysteresisStaysReadyWhileDirectionHolds(t *testing.T) {
+	h := Hysteresis{RaiseDelay: time.Second, LowerDelay: 5 * time.Second}
+	h.Step(1, time.Second)
+	for i := 0; i < 5; i++ {
+		if !h.Step(1, 10*time.Millisecond) {
+			t.Fatal("once ready, repeated samples in the same direction should stay ready")
+		}
+	}
+}
+
+func TestAsymmetricDelays(t *testing.T) {
+	h := Hysteresis{RaiseDelay: time.Second, LowerDelay: 5 * time.Second}
+	if h.Step(-1, 4999*time.Millisecond) {
+		t.Fatal("lower reported ready 1ms before lowerDelay elapsed")
+	}
+	if !h.Step(-1, time.Millisecond) {
+		t.Fatal("lower should be ready right at lowerDelay")
+	}
+}